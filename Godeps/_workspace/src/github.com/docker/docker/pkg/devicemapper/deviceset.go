@@ -0,0 +1,486 @@
+// +build linux
+
+package devicemapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	log "github.com/flynn/flynn/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+const deviceSetMetaFile = "deviceset-metadata"
+
+// DeviceMetadata is the persisted metadata for a single thin device allocated
+// from a DeviceSet's pool.
+type DeviceMetadata struct {
+	Hash          string `json:"-"`
+	DeviceId      int    `json:"device_id"`
+	Size          uint64 `json:"size"`
+	TransactionId uint64 `json:"transaction_id"`
+	Initialized   bool   `json:"initialized"`
+}
+
+// DiskUsage reports used/total blocks for a pool component, as counted in
+// the thin-pool status (data blocks of the pool's block size, metadata
+// blocks of the metadata device).
+type DiskUsage struct {
+	Used  uint64
+	Total uint64
+}
+
+// Status summarizes the current state of a DeviceSet's backing thin pool.
+type Status struct {
+	PoolName         string
+	DataFile         string
+	DataLoopback     string
+	MetadataFile     string
+	MetadataLoopback string
+	Data             DiskUsage
+	Metadata         DiskUsage
+}
+
+type deviceSetMetaData struct {
+	NextDeviceId  int    `json:"next_device_id"`
+	TransactionId uint64 `json:"transaction_id"`
+}
+
+// DeviceSet owns a thin pool and the thin devices allocated from it,
+// persisting device metadata as JSON under root so the pool can be
+// reattached across process restarts.
+type DeviceSet struct {
+	sync.Mutex
+
+	root         string
+	poolName     string
+	devicePrefix string
+
+	devices       map[string]*DeviceMetadata
+	nextDeviceId  int
+	transactionId uint64
+
+	dataFile     *os.File
+	metadataFile *os.File
+}
+
+// NewDeviceSet loads (or initializes) the device metadata kept under root
+// for the thin pool poolName, which is backed by dataFile and metadataFile.
+func NewDeviceSet(root, poolName string, dataFile, metadataFile *os.File) (*DeviceSet, error) {
+	devices := &DeviceSet{
+		root:         root,
+		poolName:     poolName,
+		devicePrefix: fmt.Sprintf("%s-", poolName),
+		devices:      make(map[string]*DeviceMetadata),
+		dataFile:     dataFile,
+		metadataFile: metadataFile,
+	}
+
+	if err := os.MkdirAll(devices.metadataDir(), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := devices.loadDeviceSetMetaData(); err != nil {
+		return nil, err
+	}
+
+	if err := devices.loadDevices(); err != nil {
+		return nil, err
+	}
+
+	status := devices.reattachPool()
+	log.Debugf("[devmapper] Reattached pool %s (data loopback=%q, metadata loopback=%q)",
+		poolName, status.DataLoopback, status.MetadataLoopback)
+
+	return devices, nil
+}
+
+func (devices *DeviceSet) metadataDir() string {
+	return filepath.Join(devices.root, "metadata")
+}
+
+func (devices *DeviceSet) deviceMetaFile(hash string) string {
+	return filepath.Join(devices.metadataDir(), hash)
+}
+
+func (devices *DeviceSet) deviceSetMetaFile() string {
+	return filepath.Join(devices.root, deviceSetMetaFile)
+}
+
+func (devices *DeviceSet) deviceName(hash string) string {
+	return devices.devicePrefix + hash
+}
+
+func (devices *DeviceSet) devicePath(hash string) string {
+	return filepath.Join("/dev/mapper", devices.deviceName(hash))
+}
+
+func (devices *DeviceSet) loadDeviceSetMetaData() error {
+	jsonData, err := ioutil.ReadFile(devices.deviceSetMetaFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	meta := &deviceSetMetaData{}
+	if err := json.Unmarshal(jsonData, meta); err != nil {
+		return fmt.Errorf("Error unmarshalling %s: %s", devices.deviceSetMetaFile(), err)
+	}
+	devices.nextDeviceId = meta.NextDeviceId
+	devices.transactionId = meta.TransactionId
+	return nil
+}
+
+func (devices *DeviceSet) saveDeviceSetMetaData() error {
+	meta := &deviceSetMetaData{
+		NextDeviceId:  devices.nextDeviceId,
+		TransactionId: devices.transactionId,
+	}
+	jsonData, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("Error encoding metadata to json: %s", err)
+	}
+	return writeMetaFile(devices.deviceSetMetaFile(), jsonData)
+}
+
+func (devices *DeviceSet) loadDevices() error {
+	files, err := ioutil.ReadDir(devices.metadataDir())
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		hash := f.Name()
+		jsonData, err := ioutil.ReadFile(devices.deviceMetaFile(hash))
+		if err != nil {
+			log.Errorf("[devmapper] Error reading metadata for device %s: %s", hash, err)
+			continue
+		}
+
+		info := &DeviceMetadata{Hash: hash}
+		if err := json.Unmarshal(jsonData, info); err != nil {
+			log.Errorf("[devmapper] Error unmarshalling metadata for device %s: %s", hash, err)
+			continue
+		}
+		devices.devices[hash] = info
+	}
+	return nil
+}
+
+func (devices *DeviceSet) saveDeviceInfo(info *DeviceMetadata) error {
+	jsonData, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("Error encoding metadata to json: %s", err)
+	}
+	return writeMetaFile(devices.deviceMetaFile(info.Hash), jsonData)
+}
+
+func writeMetaFile(path string, jsonData []byte) error {
+	tmpFile := path + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, jsonData, 0600); err != nil {
+		return fmt.Errorf("Error writing %s: %s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		return fmt.Errorf("Error renaming %s to %s: %s", tmpFile, path, err)
+	}
+	return nil
+}
+
+// incrementTransactionId bumps the pool's transaction id by one and then
+// persists the new id to disk. Reattaching the pool does not compare the
+// persisted id with the pool's own.
+func (devices *DeviceSet) incrementTransactionId() error {
+	newTransactionId := devices.transactionId + 1
+	if err := SetTransactionId(devices.poolName, devices.transactionId, newTransactionId); err != nil {
+		return fmt.Errorf("Error setting transaction id: %s", err)
+	}
+	devices.transactionId = newTransactionId
+	return devices.saveDeviceSetMetaData()
+}
+
+// AddDevice allocates a new thin device named hash, sized size bytes. If
+// baseHash is empty, hash is created as a fresh root device; otherwise it is
+// created as a snapshot of baseHash, inheriting baseHash's size.
+func (devices *DeviceSet) AddDevice(hash, baseHash string, size uint64) error {
+	devices.Lock()
+	defer devices.Unlock()
+
+	if _, exists := devices.devices[hash]; exists {
+		return fmt.Errorf("device %s already exists", hash)
+	}
+
+	var baseInfo *DeviceMetadata
+	if baseHash != "" {
+		var exists bool
+		baseInfo, exists = devices.devices[baseHash]
+		if !exists {
+			return fmt.Errorf("unknown base device %s", baseHash)
+		}
+	}
+
+	deviceId := devices.nextDeviceId
+	if err := devices.incrementTransactionId(); err != nil {
+		return err
+	}
+
+	if baseInfo == nil {
+		if err := CreateDevice(devices.poolName, &deviceId); err != nil {
+			return fmt.Errorf("Error creating device for %s: %s", hash, err)
+		}
+	} else {
+		if err := CreateSnapDevice(devices.poolName, &deviceId, devices.deviceName(baseHash), baseInfo.DeviceId); err != nil {
+			return fmt.Errorf("Error creating snap device for %s: %s", hash, err)
+		}
+		size = baseInfo.Size
+	}
+	devices.nextDeviceId = deviceId + 1
+
+	info := &DeviceMetadata{
+		Hash:          hash,
+		DeviceId:      deviceId,
+		Size:          size,
+		TransactionId: devices.transactionId,
+		Initialized:   true,
+	}
+	if err := devices.saveDeviceInfo(info); err != nil {
+		return err
+	}
+	if err := devices.saveDeviceSetMetaData(); err != nil {
+		return err
+	}
+
+	devices.devices[hash] = info
+	return nil
+}
+
+// RemoveDevice deactivates and deletes the thin device named hash.
+func (devices *DeviceSet) RemoveDevice(hash string) error {
+	devices.Lock()
+	defer devices.Unlock()
+
+	info, exists := devices.devices[hash]
+	if !exists {
+		return fmt.Errorf("unknown device %s", hash)
+	}
+
+	if err := devices.deactivateDevice(hash); err != nil {
+		return fmt.Errorf("Error deactivating device %s: %s", hash, err)
+	}
+
+	if err := devices.incrementTransactionId(); err != nil {
+		return err
+	}
+	if err := DeleteDevice(devices.poolName, info.DeviceId); err != nil {
+		return fmt.Errorf("Error deleting device %s: %s", hash, err)
+	}
+
+	if err := os.Remove(devices.deviceMetaFile(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(devices.devices, hash)
+	return nil
+}
+
+// ActivateDevice creates the dm-thin node for hash if it isn't already active.
+func (devices *DeviceSet) ActivateDevice(hash string) error {
+	devices.Lock()
+	defer devices.Unlock()
+	return devices.activateDevice(hash)
+}
+
+func (devices *DeviceSet) activateDevice(hash string) error {
+	info, exists := devices.devices[hash]
+	if !exists {
+		return fmt.Errorf("unknown device %s", hash)
+	}
+
+	name := devices.deviceName(hash)
+	if devInfo, err := GetInfo(name); err == nil && devInfo.Exists != 0 {
+		return nil
+	}
+	return ActivateDevice(devices.poolName, name, info.DeviceId, info.Size)
+}
+
+// DeactivateDevice removes the dm-thin node for hash, if active.
+func (devices *DeviceSet) DeactivateDevice(hash string) error {
+	devices.Lock()
+	defer devices.Unlock()
+	return devices.deactivateDevice(hash)
+}
+
+func (devices *DeviceSet) deactivateDevice(hash string) error {
+	name := devices.deviceName(hash)
+	devInfo, err := GetInfo(name)
+	if err != nil || devInfo.Exists == 0 {
+		return nil
+	}
+	return RemoveDevice(name)
+}
+
+// MountDevice activates (if needed) and mounts the thin device for hash at path.
+func (devices *DeviceSet) MountDevice(hash, path, mountLabel string) error {
+	devices.Lock()
+	defer devices.Unlock()
+
+	if err := devices.activateDevice(hash); err != nil {
+		return fmt.Errorf("Error activating device for %s: %s", hash, err)
+	}
+
+	options := "discard"
+	if mountLabel != "" {
+		options = fmt.Sprintf("%s,context=%q", options, mountLabel)
+	}
+
+	devPath := devices.devicePath(hash)
+	if err := syscall.Mount(devPath, path, "ext4", 0, options); err != nil {
+		return fmt.Errorf("Error mounting %s on %s: %s", devPath, path, err)
+	}
+	return nil
+}
+
+// UnmountDevice unmounts path and, if deactivate is true, removes the
+// device's dm-thin node as well.
+func (devices *DeviceSet) UnmountDevice(hash, path string, deactivate bool) error {
+	devices.Lock()
+	defer devices.Unlock()
+
+	if err := syscall.Unmount(path, 0); err != nil {
+		return fmt.Errorf("Error unmounting device %s from %s: %s", hash, path, err)
+	}
+
+	if !deactivate {
+		return nil
+	}
+	return devices.deactivateDevice(hash)
+}
+
+// HasDevice reports whether a thin device named hash is known to the set.
+func (devices *DeviceSet) HasDevice(hash string) bool {
+	devices.Lock()
+	defer devices.Unlock()
+	_, exists := devices.devices[hash]
+	return exists
+}
+
+// HasActivatedDevice reports whether the thin device named hash currently
+// has a live dm-thin node.
+func (devices *DeviceSet) HasActivatedDevice(hash string) bool {
+	devices.Lock()
+	defer devices.Unlock()
+	devInfo, err := GetInfo(devices.deviceName(hash))
+	return err == nil && devInfo.Exists != 0
+}
+
+// Shutdown deactivates every activated device in the set.
+func (devices *DeviceSet) Shutdown() error {
+	devices.Lock()
+	defer devices.Unlock()
+
+	for hash := range devices.devices {
+		if err := devices.deactivateDevice(hash); err != nil {
+			log.Errorf("[devmapper] Error deactivating device %s on shutdown: %s", hash, err)
+		}
+	}
+	return nil
+}
+
+// Status reports the pool's current loopback backing, if any.
+func (devices *DeviceSet) Status() *Status {
+	devices.Lock()
+	defer devices.Unlock()
+	return devices.reattachPool()
+}
+
+// reattachPool walks the pool's dependent devices to recover which, if any,
+// are loopback devices backing devices.dataFile / devices.metadataFile -
+// needed since a freshly started process only knows the pool name, not the
+// loop devices a previous process may have attached for it.
+func (devices *DeviceSet) reattachPool() *Status {
+	status := &Status{
+		PoolName:     devices.poolName,
+		DataFile:     devices.dataFile.Name(),
+		MetadataFile: devices.metadataFile.Name(),
+	}
+
+	deps, err := GetDeps(devices.poolName)
+	if err != nil {
+		log.Errorf("[devmapper] Error getting deps for pool %s: %s", devices.poolName, err)
+		return status
+	}
+
+	for _, dev := range deps.Device {
+		path := findDevicePathForRdev(dev)
+		if path == "" {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		backing, err := loopbackBackingFilePath(f)
+		f.Close()
+		if err != nil {
+			// Not a loop device, e.g. a raw block device or dm-linear volume.
+			continue
+		}
+
+		switch backing {
+		case status.DataFile:
+			status.DataLoopback = path
+		case status.MetadataFile:
+			status.MetadataLoopback = path
+		}
+	}
+
+	poolStatus, err := GetThinPoolStatus(devices.poolName)
+	if err != nil {
+		log.Errorf("[devmapper] Error getting pool status for %s: %s", devices.poolName, err)
+		return status
+	}
+	status.Data.Used = poolStatus.UsedDataBlocks
+	status.Data.Total = poolStatus.TotalDataBlocks
+	status.Metadata.Used = poolStatus.UsedMetadataBlocks
+	status.Metadata.Total = poolStatus.TotalMetadataBlocks
+
+	return status
+}
+
+// findDevicePathForRdev scans /dev/dm-* and /dev/loop* for a node whose
+// device number matches dev.
+func findDevicePathForRdev(dev uint64) string {
+	for _, prefix := range []string{"/dev/dm-", "/dev/loop"} {
+		for i := 0; ; i++ {
+			path := fmt.Sprintf("%s%d", prefix, i)
+			fi, err := os.Stat(path)
+			if err != nil {
+				break
+			}
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Rdev == dev {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// loopbackBackingFilePath returns the source file name a loop device was
+// attached to, as reported by LOOP_GET_STATUS64.
+func loopbackBackingFilePath(loopFile *os.File) (string, error) {
+	info, err := ioctlLoopGetStatus64(loopFile.Fd())
+	if err != nil {
+		return "", err
+	}
+	name := info.loFileName[:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return string(name), nil
+}
@@ -6,43 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"runtime"
 	"syscall"
 
 	log "github.com/flynn/flynn/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 )
 
-type DevmapperLogger interface {
-	DMLog(level int, file string, line int, dmError int, message string)
-}
-
-const (
-	DeviceCreate TaskType = iota
-	DeviceReload
-	DeviceRemove
-	DeviceRemoveAll
-	DeviceSuspend
-	DeviceResume
-	DeviceInfo
-	DeviceDeps
-	DeviceRename
-	DeviceVersion
-	DeviceStatus
-	DeviceTable
-	DeviceWaitevent
-	DeviceList
-	DeviceClear
-	DeviceMknodes
-	DeviceListVersions
-	DeviceTargetMsg
-	DeviceSetGeometry
-)
-
-const (
-	AddNodeOnResume AddNodeType = iota
-	AddNodeOnCreate
-)
-
 var (
 	ErrTaskRun                = errors.New("dm_task_run failed")
 	ErrTaskSetName            = errors.New("dm_task_set_name failed")
@@ -72,157 +40,6 @@ var (
 	dmSawExist bool
 )
 
-type (
-	Task struct {
-		unmanaged *CDmTask
-	}
-	Deps struct {
-		Count  uint32
-		Filler uint32
-		Device []uint64
-	}
-	Info struct {
-		Exists        int
-		Suspended     int
-		LiveTable     int
-		InactiveTable int
-		OpenCount     int32
-		EventNr       uint32
-		Major         uint32
-		Minor         uint32
-		ReadOnly      int
-		TargetCount   int32
-	}
-	TaskType    int
-	AddNodeType int
-)
-
-func (t *Task) destroy() {
-	if t != nil {
-		DmTaskDestroy(t.unmanaged)
-		runtime.SetFinalizer(t, nil)
-	}
-}
-
-// TaskCreateNamed is a convenience function for TaskCreate when a name
-// will be set on the task as well
-func TaskCreateNamed(t TaskType, name string) (*Task, error) {
-	task := TaskCreate(t)
-	if task == nil {
-		return nil, fmt.Errorf("Can't create task of type %d", int(t))
-	}
-	if err := task.SetName(name); err != nil {
-		return nil, fmt.Errorf("Can't set task name %s", name)
-	}
-	return task, nil
-}
-
-// TaskCreate initializes a devicemapper task of tasktype
-func TaskCreate(tasktype TaskType) *Task {
-	Ctask := DmTaskCreate(int(tasktype))
-	if Ctask == nil {
-		return nil
-	}
-	task := &Task{unmanaged: Ctask}
-	runtime.SetFinalizer(task, (*Task).destroy)
-	return task
-}
-
-func (t *Task) Run() error {
-	if res := DmTaskRun(t.unmanaged); res != 1 {
-		return ErrTaskRun
-	}
-	return nil
-}
-
-func (t *Task) SetName(name string) error {
-	if res := DmTaskSetName(t.unmanaged, name); res != 1 {
-		return ErrTaskSetName
-	}
-	return nil
-}
-
-func (t *Task) SetMessage(message string) error {
-	if res := DmTaskSetMessage(t.unmanaged, message); res != 1 {
-		return ErrTaskSetMessage
-	}
-	return nil
-}
-
-func (t *Task) SetSector(sector uint64) error {
-	if res := DmTaskSetSector(t.unmanaged, sector); res != 1 {
-		return ErrTaskSetSector
-	}
-	return nil
-}
-
-func (t *Task) SetCookie(cookie *uint, flags uint16) error {
-	if cookie == nil {
-		return ErrNilCookie
-	}
-	if res := DmTaskSetCookie(t.unmanaged, cookie, flags); res != 1 {
-		return ErrTaskSetCookie
-	}
-	return nil
-}
-
-func (t *Task) SetAddNode(addNode AddNodeType) error {
-	if addNode != AddNodeOnResume && addNode != AddNodeOnCreate {
-		return ErrInvalidAddNode
-	}
-	if res := DmTaskSetAddNode(t.unmanaged, addNode); res != 1 {
-		return ErrTaskSetAddNode
-	}
-	return nil
-}
-
-func (t *Task) SetRo() error {
-	if res := DmTaskSetRo(t.unmanaged); res != 1 {
-		return ErrTaskSetRo
-	}
-	return nil
-}
-
-func (t *Task) AddTarget(start, size uint64, ttype, params string) error {
-	if res := DmTaskAddTarget(t.unmanaged, start, size,
-		ttype, params); res != 1 {
-		return ErrTaskAddTarget
-	}
-	return nil
-}
-
-func (t *Task) GetDeps() (*Deps, error) {
-	var deps *Deps
-	if deps = DmTaskGetDeps(t.unmanaged); deps == nil {
-		return nil, ErrTaskGetDeps
-	}
-	return deps, nil
-}
-
-func (t *Task) GetInfo() (*Info, error) {
-	info := &Info{}
-	if res := DmTaskGetInfo(t.unmanaged, info); res != 1 {
-		return nil, ErrTaskGetInfo
-	}
-	return info, nil
-}
-
-func (t *Task) GetDriverVersion() (string, error) {
-	res := DmTaskGetDriverVersion(t.unmanaged)
-	if res == "" {
-		return "", ErrTaskGetDriverVersion
-	}
-	return res, nil
-}
-
-func (t *Task) GetNextTarget(next uintptr) (nextPtr uintptr, start uint64,
-	length uint64, targetType string, params string) {
-
-	return DmGetNextTarget(t.unmanaged, next, &start, &length,
-			&targetType, &params),
-		start, length, targetType, params
-}
-
 func getLoopbackBackingFile(file *os.File) (uint64, uint64, error) {
 	loopInfo, err := ioctlLoopGetStatus64(file.Fd())
 	if err != nil {
@@ -272,40 +89,90 @@ func FindLoopDeviceFor(file *os.File) *os.File {
 	return nil
 }
 
-func UdevWait(cookie uint) error {
-	if res := DmUdevWait(cookie); res != 1 {
-		log.Debugf("Failed to wait on udev cookie %d", cookie)
-		return ErrUdevWait
-	}
-	return nil
+func stringToLoopName(src string) [LoNameSize]uint8 {
+	var dst [LoNameSize]uint8
+	copy(dst[:], src)
+	return dst
 }
 
-func LogInitVerbose(level int) {
-	DmLogInitVerbose(level)
+func getNextFreeLoopbackIndex() (int, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer ctl.Close()
+
+	return ioctlLoopCtlGetFree(ctl.Fd())
 }
 
-var dmLogger DevmapperLogger = nil
+// AttachLoopDevice finds a free loopback device (via /dev/loop-control when
+// available) and attaches filename to it, returning the open loopback file.
+func AttachLoopDevice(filename string) (*os.File, error) {
+	startIndex, err := getNextFreeLoopbackIndex()
+	if err != nil {
+		log.Debugf("Error retrieving the next available loopback: %s", err)
+		startIndex = 0
+	}
 
-// initialize the logger for the device mapper library
-func LogInit(logger DevmapperLogger) {
-	dmLogger = logger
-	LogWithErrnoInit()
-}
+	sparseFile, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		log.Errorf("Error opening sparse file %s: %s", filename, err)
+		return nil, ErrAttachLoopbackDevice
+	}
+	defer sparseFile.Close()
+
+	var loopFile *os.File
+	for index := startIndex; ; index++ {
+		target := fmt.Sprintf("/dev/loop%d", index)
+
+		fi, err := os.Stat(target)
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Errorf("There are no more loopback devices available.")
+			}
+			return nil, ErrAttachLoopbackDevice
+		}
+		if fi.Mode()&os.ModeDevice != os.ModeDevice {
+			log.Errorf("Loopback device %s is not a block device.", target)
+			continue
+		}
+
+		loopFile, err = os.OpenFile(target, os.O_RDWR, 0644)
+		if err != nil {
+			log.Errorf("Error opening loopback device %s: %s", target, err)
+			return nil, ErrAttachLoopbackDevice
+		}
+
+		if err := ioctlLoopSetFd(loopFile.Fd(), sparseFile.Fd()); err != nil {
+			loopFile.Close()
+			if err == syscall.EBUSY {
+				continue
+			}
+			log.Errorf("Cannot set up loopback device %s: %s", target, err)
+			return nil, ErrAttachLoopbackDevice
+		}
+		break
+	}
 
-func SetDevDir(dir string) error {
-	if res := DmSetDevDir(dir); res != 1 {
-		log.Debugf("Error dm_set_dev_dir")
-		return ErrSetDevDir
+	loopInfo := &loopInfo64{
+		loFileName: stringToLoopName(sparseFile.Name()),
+		loFlags:    LoFlagsAutoClear,
 	}
-	return nil
+	if err := ioctlLoopSetStatus64(loopFile.Fd(), loopInfo); err != nil {
+		log.Errorf("Cannot set up loopback device info: %s", err)
+		ioctlLoopClrFd(loopFile.Fd())
+		loopFile.Close()
+		return nil, ErrAttachLoopbackDevice
+	}
+
+	return loopFile, nil
 }
 
-func GetLibraryVersion() (string, error) {
-	var version string
-	if res := DmGetLibraryVersion(&version); res != 1 {
-		return "", ErrGetLibraryVersion
-	}
-	return version, nil
+// DetachLoopDevice clears the backing file association on a loopback device
+// previously returned by AttachLoopDevice or FindLoopDeviceFor.
+func DetachLoopDevice(loopFile *os.File) error {
+	defer loopFile.Close()
+	return ioctlLoopClrFd(loopFile.Fd())
 }
 
 // Useful helper for cleanup
@@ -420,6 +287,86 @@ func ReloadPool(poolName string, dataFile, metadataFile *os.File, poolBlockSize
 	return nil
 }
 
+// ResizePool grows poolName to match its already-extended backing files.
+// dataFile and metadataFile are the loopback devices attached to those
+// files: it grows their loopback capacity, then suspends, reloads and
+// resumes the pool's table with the new size.
+func ResizePool(poolName string, dataFile, metadataFile *os.File, poolBlockSize uint32) error {
+	if err := LoopbackSetCapacity(dataFile); err != nil {
+		return fmt.Errorf("Error resizing data loopback capacity: %s", err)
+	}
+	if err := LoopbackSetCapacity(metadataFile); err != nil {
+		return fmt.Errorf("Error resizing metadata loopback capacity: %s", err)
+	}
+
+	size, err := GetBlockDeviceSize(dataFile)
+	if err != nil {
+		return fmt.Errorf("Can't get data size %s", err)
+	}
+
+	if err := SuspendDevice(poolName); err != nil {
+		return fmt.Errorf("Error suspending pool %s: %s", poolName, err)
+	}
+
+	task, err := TaskCreateNamed(DeviceReload, poolName)
+	if task == nil {
+		ResumeDevice(poolName)
+		return err
+	}
+
+	params := fmt.Sprintf("%s %s %d 32768 1 skip_block_zeroing", metadataFile.Name(), dataFile.Name(), poolBlockSize)
+	if err := task.AddTarget(0, size/512, "thin-pool", params); err != nil {
+		ResumeDevice(poolName)
+		return fmt.Errorf("Can't add target %s", err)
+	}
+
+	if err := task.Run(); err != nil {
+		ResumeDevice(poolName)
+		return fmt.Errorf("Error running DeviceReload (ResizePool) %s", err)
+	}
+
+	return ResumeDevice(poolName)
+}
+
+// ResizeDevice reloads name's thin target so that it is newSize bytes long
+// (newSize/512 sectors). poolName and deviceId must match the thin pool and device id name
+// was activated with (see ActivateDevice); they identify the same "thin"
+// target table params, not status output.
+func ResizeDevice(name, poolName string, deviceId int, newSize uint64) error {
+	devinfo, err := GetInfo(name)
+	if err != nil {
+		return fmt.Errorf("Error getting info for %s: %s", name, err)
+	}
+
+	params := fmt.Sprintf("%s %d", poolName, deviceId)
+	task, err := TaskCreateNamed(DeviceReload, name)
+	if task == nil {
+		return err
+	}
+	if err := task.AddTarget(0, newSize/512, "thin", params); err != nil {
+		return fmt.Errorf("Can't add target %s", err)
+	}
+
+	wasSuspended := devinfo.Suspended != 0
+	if !wasSuspended {
+		if err := SuspendDevice(name); err != nil {
+			return fmt.Errorf("Error suspending device %s: %s", name, err)
+		}
+	}
+
+	if err := task.Run(); err != nil {
+		if !wasSuspended {
+			ResumeDevice(name)
+		}
+		return fmt.Errorf("Error running DeviceReload (ResizeDevice) %s", err)
+	}
+
+	if !wasSuspended {
+		return ResumeDevice(name)
+	}
+	return nil
+}
+
 func GetDeps(name string) (*Deps, error) {
 	task, err := TaskCreateNamed(DeviceDeps, name)
 	if task == nil {
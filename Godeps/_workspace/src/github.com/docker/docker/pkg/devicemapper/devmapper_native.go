@@ -0,0 +1,494 @@
+// +build linux,!cgo
+
+package devicemapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	log "github.com/flynn/flynn/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// This file implements the Task API directly against the kernel's DM_*
+// ioctl protocol on /dev/mapper/control, so that this package can be built
+// without cgo or libdevmapper.so. It is used instead of devmapper_cgo.go
+// whenever CGO_ENABLED=0.
+
+// DevmapperLogger is the interface of the logger installed with LogInit.
+// The native backend delivers no messages to it; its ioctl failures are
+// logged through logrus directly.
+type DevmapperLogger interface {
+	DMLog(level int, file string, line int, dmError int, message string)
+}
+
+const (
+	DeviceCreate TaskType = iota
+	DeviceReload
+	DeviceRemove
+	DeviceRemoveAll
+	DeviceSuspend
+	DeviceResume
+	DeviceInfo
+	DeviceDeps
+	DeviceRename
+	DeviceVersion
+	DeviceStatus
+	DeviceTable
+	DeviceWaitevent
+	DeviceList
+	DeviceClear
+	DeviceMknodes
+	DeviceListVersions
+	DeviceTargetMsg
+	DeviceSetGeometry
+)
+
+const (
+	AddNodeOnResume AddNodeType = iota
+	AddNodeOnCreate
+)
+
+const (
+	dmIoctlVersionMajor = 4
+	dmIoctlVersionMinor = 0
+	dmIoctlVersionPatch = 0
+
+	dmNameLen = 128
+	dmUuidLen = 129
+
+	dmReadonlyFlag     = 1 << 0
+	dmSuspendFlag      = 1 << 1
+	dmExistsFlag       = 1 << 2
+	dmActivePresent    = 1 << 5
+	dmInactivePresent  = 1 << 6
+	dmDeviceSpecAlign  = 8
+	dmIoctlBaseSize    = 312 // size of struct dm_ioctl on amd64
+	dmTargetSpecSize   = 40  // sector_start, length, status, next (uint32), target_type[16]
+	dmTargetTypeLength = 16
+)
+
+// DM_* ioctl numbers, computed as _IOWR(0xfd, nr, struct dm_ioctl) with
+// sizeof(struct dm_ioctl) == dmIoctlBaseSize (312 bytes on amd64).
+const (
+	dmDevCreate     = 0xc138fd03
+	dmDevRemove     = 0xc138fd04
+	dmDevSuspend    = 0xc138fd06
+	dmDevStatus     = 0xc138fd07
+	dmTableLoad     = 0xc138fd09
+	dmTableClear    = 0xc138fd0a
+	dmTableDeps     = 0xc138fd0b
+	dmTableStatus   = 0xc138fd0c
+	dmTargetMsg     = 0xc138fd0e
+)
+
+// TaskType mirrors the values in devmapper_cgo.go; only one of the two
+// backend files is ever compiled.
+type TaskType int
+
+// AddNodeType mirrors the values in devmapper_cgo.go.
+type AddNodeType int
+
+// Deps is the decoded form of a DM_DEV_DEPS reply.
+type Deps struct {
+	Count  uint32
+	Filler uint32
+	Device []uint64
+}
+
+// Info is the decoded form of a struct dm_ioctl's status fields.
+type Info struct {
+	Exists        int
+	Suspended     int
+	LiveTable     int
+	InactiveTable int
+	OpenCount     int32
+	EventNr       uint32
+	Major         uint32
+	Minor         uint32
+	ReadOnly      int
+	TargetCount   int32
+}
+
+type dmTarget struct {
+	start, length uint64
+	ttype         string
+	params        string
+}
+
+// Task accumulates targets/messages and dispatches them on Run, as a single
+// DM_* ioctl (three for a DeviceCreate that carries targets).
+type Task struct {
+	tasktype TaskType
+	name     string
+	message  string
+	sector   uint64
+	addNode  AddNodeType
+	ro       bool
+	targets  []dmTarget
+	info     Info
+	deps     *Deps
+}
+
+func controlFd() (*os.File, error) {
+	return os.OpenFile("/dev/mapper/control", os.O_RDWR, 0)
+}
+
+// TaskCreateNamed is a convenience function for TaskCreate when a name
+// will be set on the task as well
+func TaskCreateNamed(t TaskType, name string) (*Task, error) {
+	task := TaskCreate(t)
+	if task == nil {
+		return nil, fmt.Errorf("Can't create task of type %d", int(t))
+	}
+	if err := task.SetName(name); err != nil {
+		return nil, ErrTaskSetName
+	}
+	return task, nil
+}
+
+// TaskCreate initializes a devicemapper task of tasktype
+func TaskCreate(tasktype TaskType) *Task {
+	return &Task{tasktype: tasktype}
+}
+
+func (t *Task) SetName(name string) error {
+	if len(name) >= dmNameLen {
+		return ErrTaskSetName
+	}
+	t.name = name
+	return nil
+}
+
+func (t *Task) SetMessage(message string) error {
+	t.message = message
+	return nil
+}
+
+func (t *Task) SetSector(sector uint64) error {
+	t.sector = sector
+	return nil
+}
+
+func (t *Task) SetCookie(cookie *uint, flags uint16) error {
+	if cookie == nil {
+		return ErrNilCookie
+	}
+	// The native backend has no libdevmapper udev cookie to hand back;
+	// callers synchronize on the ioctl return instead.
+	*cookie = 0
+	return nil
+}
+
+func (t *Task) SetAddNode(addNode AddNodeType) error {
+	if addNode != AddNodeOnResume && addNode != AddNodeOnCreate {
+		return ErrInvalidAddNode
+	}
+	t.addNode = addNode
+	return nil
+}
+
+func (t *Task) SetRo() error {
+	t.ro = true
+	return nil
+}
+
+func (t *Task) AddTarget(start, size uint64, ttype, params string) error {
+	if len(ttype) >= dmTargetTypeLength {
+		return ErrTaskAddTarget
+	}
+	t.targets = append(t.targets, dmTarget{start: start, length: size, ttype: ttype, params: params})
+	return nil
+}
+
+func (t *Task) GetDeps() (*Deps, error) {
+	if t.deps == nil {
+		return nil, ErrTaskGetDeps
+	}
+	return t.deps, nil
+}
+
+func (t *Task) GetInfo() (*Info, error) {
+	info := t.info
+	return &info, nil
+}
+
+func (t *Task) GetDriverVersion() (string, error) {
+	return "", ErrTaskGetDriverVersion
+}
+
+func (t *Task) GetNextTarget(next uintptr) (nextPtr uintptr, start uint64,
+	length uint64, targetType string, params string) {
+
+	i := int(next)
+	if i < 0 || i >= len(t.targets) {
+		return 0, 0, 0, "", ""
+	}
+	target := t.targets[i]
+	nextPtr = uintptr(i + 1)
+	if nextPtr >= uintptr(len(t.targets)) {
+		nextPtr = 0
+	}
+	return nextPtr, target.start, target.length, target.ttype, target.params
+}
+
+// ioctlNumberFor maps a TaskType to the DM_* ioctl it issues. DeviceCreate is
+// handled separately by Run when it carries targets, since a table can't be
+// loaded in the same ioctl that creates the device node. DeviceSuspend and
+// DeviceResume share DM_DEV_SUSPEND here too: the kernel tells them apart by
+// the suspend flag in the request header, not by the ioctl number, so Run
+// sets that flag itself rather than here.
+func ioctlNumberFor(t TaskType) (uintptr, error) {
+	switch t {
+	case DeviceCreate:
+		return dmDevCreate, nil
+	case DeviceReload:
+		return dmTableLoad, nil
+	case DeviceRemove:
+		return dmDevRemove, nil
+	case DeviceSuspend, DeviceResume:
+		return dmDevSuspend, nil
+	case DeviceInfo:
+		return dmDevStatus, nil
+	case DeviceStatus:
+		return dmTableStatus, nil
+	case DeviceDeps:
+		return dmTableDeps, nil
+	case DeviceTargetMsg:
+		return dmTargetMsg, nil
+	default:
+		return 0, fmt.Errorf("devicemapper: unsupported task type %d in native backend", int(t))
+	}
+}
+
+// marshalTargets packs t.targets as a sequence of dm_target_spec records
+// (sector_start, length, status, next, 16-byte target type, NUL-terminated
+// params padded to an 8-byte boundary) appended after the dm_ioctl header.
+func marshalTargets(buf *bytes.Buffer, targets []dmTarget) {
+	for i, target := range targets {
+		specStart := buf.Len()
+
+		binary.Write(buf, binary.LittleEndian, target.start)
+		binary.Write(buf, binary.LittleEndian, target.length)
+		binary.Write(buf, binary.LittleEndian, int32(0)) // status
+
+		// next: filled in below once we know this record's length
+		binary.Write(buf, binary.LittleEndian, uint32(0))
+
+		var ttype [dmTargetTypeLength]byte
+		copy(ttype[:], target.ttype)
+		buf.Write(ttype[:])
+
+		buf.WriteString(target.params)
+		buf.WriteByte(0)
+		for buf.Len()%dmDeviceSpecAlign != 0 {
+			buf.WriteByte(0)
+		}
+
+		next := uint32(0)
+		if i < len(targets)-1 {
+			next = uint32(buf.Len() - specStart)
+		}
+		binary.LittleEndian.PutUint32(buf.Bytes()[specStart+20:specStart+24], next)
+	}
+}
+
+// doIoctl issues a single DM_* ioctl. includeTargets controls whether
+// t.targets is marshalled into the payload: a DM_DEV_CREATE that precedes a
+// separate DM_TABLE_LOAD must go out tableless, even if the task already has
+// targets queued up for that later step. reqFlags is OR'd into the outbound
+// flags word, used to set DM_SUSPEND_FLAG to tell DM_DEV_SUSPEND apart from
+// a resume.
+func (t *Task) doIoctl(fd uintptr, cmd uintptr, reqFlags uint32, includeTargets bool) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// Reserve room for the dm_ioctl header; it is filled in with the real
+	// data_size/data_start once the rest of the payload is known.
+	buf.Write(make([]byte, dmIoctlBaseSize))
+
+	if includeTargets && len(t.targets) > 0 {
+		marshalTargets(&buf, t.targets)
+	} else if t.message != "" {
+		binary.Write(&buf, binary.LittleEndian, t.sector)
+		buf.WriteString(t.message)
+		buf.WriteByte(0)
+	}
+
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[0:4], dmIoctlVersionMajor)
+	binary.LittleEndian.PutUint32(data[4:8], dmIoctlVersionMinor)
+	binary.LittleEndian.PutUint32(data[8:12], dmIoctlVersionPatch)
+	binary.LittleEndian.PutUint32(data[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[16:20], uint32(dmIoctlBaseSize))
+	binary.LittleEndian.PutUint32(data[28:32], reqFlags)
+
+	// struct dm_ioctl: version[3] data_size data_start target_count
+	// open_count flags event_nr padding dev name[128] uuid[129] data[7]
+	var name [dmNameLen]byte
+	copy(name[:], t.name)
+	copy(data[48:48+dmNameLen], name[:])
+
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, cmd, uintptr(unsafe.Pointer(&data[0])))
+		if errno == 0 {
+			break
+		}
+		if errno == syscall.ENOMEM {
+			grown := make([]byte, len(data)*2)
+			copy(grown, data)
+			binary.LittleEndian.PutUint32(grown[12:16], uint32(len(grown)))
+			data = grown
+			continue
+		}
+		return nil, errno
+	}
+
+	return data, nil
+}
+
+// ioctlFailed records the busy/exist signals CreateDevice/CreateSnapDevice/
+// RemoveDevice poll for and normalizes any ioctl failure to ErrTaskRun.
+func (t *Task) ioctlFailed(err error) error {
+	if err == syscall.EBUSY {
+		dmSawBusy = true
+	} else if err == syscall.EEXIST {
+		dmSawExist = true
+	}
+	log.Debugf("[devmapper] native ioctl failed: %s", err)
+	return ErrTaskRun
+}
+
+func (t *Task) Run() error {
+	ctl, err := controlFd()
+	if err != nil {
+		return ErrTaskRun
+	}
+	defer ctl.Close()
+
+	var data []byte
+
+	switch {
+	case t.tasktype == DeviceCreate && len(t.targets) > 0:
+		// DM_DEV_CREATE only ever creates an empty, tableless device; the
+		// real kernel sequence to bring up a device with a table is
+		// DM_DEV_CREATE (tableless) -> DM_TABLE_LOAD (inactive table) ->
+		// DM_DEV_SUSPEND (resume, activating the loaded table).
+		if _, err := t.doIoctl(ctl.Fd(), dmDevCreate, 0, false); err != nil {
+			return t.ioctlFailed(err)
+		}
+		if _, err := t.doIoctl(ctl.Fd(), dmTableLoad, 0, true); err != nil {
+			return t.ioctlFailed(err)
+		}
+		data, err = t.doIoctl(ctl.Fd(), dmDevSuspend, 0, false)
+	case t.tasktype == DeviceSuspend:
+		data, err = t.doIoctl(ctl.Fd(), dmDevSuspend, dmSuspendFlag, true)
+	default:
+		var cmd uintptr
+		cmd, err = ioctlNumberFor(t.tasktype)
+		if err != nil {
+			return err
+		}
+		data, err = t.doIoctl(ctl.Fd(), cmd, 0, true)
+	}
+	if err != nil {
+		return t.ioctlFailed(err)
+	}
+
+	flags := binary.LittleEndian.Uint32(data[28:32])
+	dev := binary.LittleEndian.Uint64(data[40:48])
+	t.info = Info{
+		Exists:        boolToInt(flags&dmExistsFlag != 0),
+		Suspended:     boolToInt(flags&dmSuspendFlag != 0),
+		LiveTable:     boolToInt(flags&dmActivePresent != 0),
+		InactiveTable: boolToInt(flags&dmInactivePresent != 0),
+		ReadOnly:      boolToInt(flags&dmReadonlyFlag != 0),
+		OpenCount:     int32(binary.LittleEndian.Uint32(data[24:28])),
+		EventNr:       binary.LittleEndian.Uint32(data[32:36]),
+		Major:         uint32((dev >> 8) & 0xfff),
+		Minor:         uint32(dev & 0xff),
+		TargetCount:   int32(binary.LittleEndian.Uint32(data[20:24])),
+	}
+
+	if t.tasktype == DeviceDeps {
+		t.deps = parseDeps(data[dmIoctlBaseSize:])
+	}
+	if t.tasktype == DeviceStatus || t.tasktype == DeviceInfo {
+		t.targets = parseTargetSpecs(data[dmIoctlBaseSize:], int(t.info.TargetCount))
+	}
+
+	return nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func parseDeps(data []byte) *Deps {
+	if len(data) < 8 {
+		return &Deps{}
+	}
+	count := binary.LittleEndian.Uint32(data[0:4])
+	deps := &Deps{Count: count, Filler: binary.LittleEndian.Uint32(data[4:8])}
+	offset := 8
+	for i := uint32(0); i < count && offset+8 <= len(data); i++ {
+		deps.Device = append(deps.Device, binary.LittleEndian.Uint64(data[offset:offset+8]))
+		offset += 8
+	}
+	return deps
+}
+
+func parseTargetSpecs(data []byte, count int) []dmTarget {
+	var targets []dmTarget
+	offset := 0
+	for i := 0; i < count && offset+dmTargetSpecSize <= len(data); i++ {
+		start := binary.LittleEndian.Uint64(data[offset : offset+8])
+		length := binary.LittleEndian.Uint64(data[offset+8 : offset+16])
+		next := binary.LittleEndian.Uint32(data[offset+20 : offset+24])
+		ttype := string(bytes.TrimRight(data[offset+24:offset+24+dmTargetTypeLength], "\x00"))
+
+		paramsStart := offset + dmTargetSpecSize
+		paramsEnd := paramsStart
+		for paramsEnd < len(data) && data[paramsEnd] != 0 {
+			paramsEnd++
+		}
+		params := string(data[paramsStart:paramsEnd])
+
+		targets = append(targets, dmTarget{start: start, length: length, ttype: ttype, params: params})
+
+		if next == 0 {
+			break
+		}
+		offset += int(next)
+	}
+	return targets
+}
+
+func UdevWait(cookie uint) error {
+	// No libdevmapper udev cookie exists in the native backend; the ioctl
+	// itself only returns once the kernel has applied the change, so there
+	// is nothing further to wait on.
+	return nil
+}
+
+var dmLogger DevmapperLogger = nil
+
+// LogInit stores logger; the native backend never calls it.
+func LogInit(logger DevmapperLogger) {
+	dmLogger = logger
+}
+
+func LogInitVerbose(level int) {}
+
+func SetDevDir(dir string) error {
+	return nil
+}
+
+func GetLibraryVersion() (string, error) {
+	return "", ErrGetLibraryVersion
+}
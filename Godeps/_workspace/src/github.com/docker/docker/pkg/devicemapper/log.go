@@ -0,0 +1,56 @@
+// +build linux
+
+package devicemapper
+
+import (
+	"strings"
+
+	log "github.com/flynn/flynn/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// libdevmapper log levels, from dm-log.h.
+const (
+	logFatal  = 2
+	logErr    = 3
+	logWarn   = 4
+	logNotice = 5
+	logInfo   = 6
+	logDebug  = 7
+)
+
+// LogrusDevmapperLogger bridges DMLog callbacks from the device-mapper
+// backend into logrus, so libdm log output isn't silently dropped when no
+// caller installs its own logger via LogInit.
+type LogrusDevmapperLogger struct{}
+
+func (l *LogrusDevmapperLogger) DMLog(level int, file string, line int, dmError int, message string) {
+	fields := log.Fields{
+		"file":     file,
+		"line":     line,
+		"dm_errno": dmError,
+	}
+
+	switch level {
+	case logFatal, logErr:
+		log.WithFields(fields).Error(message)
+	case logWarn:
+		log.WithFields(fields).Warn(message)
+	case logNotice, logInfo:
+		log.WithFields(fields).Info(message)
+	case logDebug:
+		log.WithFields(fields).Debug(message)
+	default:
+		log.WithFields(fields).Debugf("[unknown log level %d] %s", level, message)
+	}
+
+	if strings.Contains(message, "Device or resource busy") {
+		dmSawBusy = true
+	}
+	if strings.Contains(message, "File exists") {
+		dmSawExist = true
+	}
+}
+
+func init() {
+	LogInit(&LogrusDevmapperLogger{})
+}
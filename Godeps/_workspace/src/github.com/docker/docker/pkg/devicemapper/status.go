@@ -0,0 +1,139 @@
+// +build linux
+
+package devicemapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/flynn/flynn/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// ThinPoolStatus is the parsed form of a thin-pool target's status params,
+// as documented in Documentation/device-mapper/thin-provisioning.txt.
+type ThinPoolStatus struct {
+	TransactionId       uint64
+	UsedMetadataBlocks  uint64
+	TotalMetadataBlocks uint64
+	UsedDataBlocks      uint64
+	TotalDataBlocks     uint64
+	HeldMetadataRoot    string
+	ReadOnly            bool
+	OutOfDataSpace      bool
+	DiscardPassdown     bool
+	NeedsCheck          bool
+}
+
+// ThinStatus is the parsed form of a thin device target's status params.
+type ThinStatus struct {
+	NrMappedSectors     uint64
+	HighestMappedSector uint64
+}
+
+func parseBlockPair(s string) (used, total uint64, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("unexpected block pair %q", s)
+	}
+	if used, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if total, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	return used, total, nil
+}
+
+// ParseThinPoolStatus parses the params string returned by GetStatus for a
+// thin-pool device.
+func ParseThinPoolStatus(params string) (*ThinPoolStatus, error) {
+	fields := strings.Fields(params)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("unexpected thin-pool status %q", params)
+	}
+
+	status := &ThinPoolStatus{}
+
+	transactionId, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing transaction id %q: %s", fields[0], err)
+	}
+	status.TransactionId = transactionId
+
+	if status.UsedMetadataBlocks, status.TotalMetadataBlocks, err = parseBlockPair(fields[1]); err != nil {
+		return nil, fmt.Errorf("Error parsing metadata blocks %q: %s", fields[1], err)
+	}
+	if status.UsedDataBlocks, status.TotalDataBlocks, err = parseBlockPair(fields[2]); err != nil {
+		return nil, fmt.Errorf("Error parsing data blocks %q: %s", fields[2], err)
+	}
+
+	if fields[3] != "-" {
+		status.HeldMetadataRoot = fields[3]
+	}
+
+	switch fields[4] {
+	case "ro":
+		status.ReadOnly = true
+	case "out_of_data_space":
+		status.OutOfDataSpace = true
+	case "rw":
+	default:
+		return nil, fmt.Errorf("unexpected thin-pool mode %q", fields[4])
+	}
+
+	for _, field := range fields[5:] {
+		switch field {
+		case "discard_passdown":
+			status.DiscardPassdown = true
+		case "no_discard_passdown", "-":
+		case "needs_check":
+			status.NeedsCheck = true
+		default:
+			log.Debugf("[devmapper] ParseThinPoolStatus: ignoring unknown field %q", field)
+		}
+	}
+
+	return status, nil
+}
+
+// ParseThinStatus parses the params string returned by GetStatus for a thin
+// device.
+func ParseThinStatus(params string) (*ThinStatus, error) {
+	fields := strings.Fields(params)
+	if len(fields) == 0 || fields[0] == "-" {
+		return &ThinStatus{}, nil
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected thin status %q", params)
+	}
+
+	nrMapped, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing nr_mapped_sectors %q: %s", fields[0], err)
+	}
+	highest, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing highest_mapped_sector %q: %s", fields[1], err)
+	}
+
+	return &ThinStatus{NrMappedSectors: nrMapped, HighestMappedSector: highest}, nil
+}
+
+// GetThinPoolStatus returns the parsed status of the thin-pool device name.
+func GetThinPoolStatus(name string) (*ThinPoolStatus, error) {
+	_, _, _, params, err := GetStatus(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseThinPoolStatus(params)
+}
+
+// GetThinStatus returns the parsed status of the thin device name.
+func GetThinStatus(name string) (*ThinStatus, error) {
+	_, _, _, params, err := GetStatus(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseThinStatus(params)
+}